@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/caiyeon/goldfish/vault"
+	"github.com/labstack/echo"
+)
+
+// adminPolicy is the vault policy a token must carry to reach
+// admin-only endpoints like ListSessions or ForceRotateKeys
+const adminPolicy = "goldfish-admin"
+
+// requireAdmin behaves like getSession (auth, CSRF on mutating methods),
+// then additionally confirms the caller's vault token carries
+// adminPolicy. It writes the response and returns nil on any failure, so
+// callers can treat a nil return the same way they do with getSession
+func requireAdmin(c echo.Context) *vault.AuthInfo {
+	auth := getSession(c)
+	if auth == nil {
+		return nil
+	}
+
+	// RenewSelf is the cheapest vault call that hands back the token's
+	// current policies; goldfish already uses it for session upkeep
+	resp, err := auth.RenewSelf()
+	if err != nil {
+		auth.Clear()
+		parseError(c, err)
+		return nil
+	}
+
+	for _, policy := range resp.Auth.Policies {
+		if policy == adminPolicy {
+			return auth
+		}
+	}
+
+	auth.Clear()
+	c.JSON(http.StatusForbidden, H{
+		"error": "This endpoint requires the " + adminPolicy + " policy",
+	})
+	return nil
+}
@@ -0,0 +1,45 @@
+package handlers
+
+import "testing"
+
+func TestNewAndValidCSRFToken(t *testing.T) {
+	sess := &Session{CSRFSecret: "session-secret"}
+
+	token, err := newCSRFToken(sess)
+	if err != nil {
+		t.Fatalf("newCSRFToken returned error: %v", err)
+	}
+
+	if !validCSRFToken(sess, token) {
+		t.Errorf("expected token minted for sess to validate against sess, got false")
+	}
+}
+
+func TestValidCSRFTokenRejectsWrongSession(t *testing.T) {
+	sess := &Session{CSRFSecret: "session-secret"}
+	other := &Session{CSRFSecret: "different-secret"}
+
+	token, err := newCSRFToken(sess)
+	if err != nil {
+		t.Fatalf("newCSRFToken returned error: %v", err)
+	}
+
+	if validCSRFToken(other, token) {
+		t.Errorf("token minted for one session must not validate against another")
+	}
+}
+
+func TestValidCSRFTokenRejectsMalformedInput(t *testing.T) {
+	sess := &Session{CSRFSecret: "session-secret"}
+
+	cases := []string{"", "no-dot-here", "too.many.dots", "."}
+	for _, presented := range cases {
+		if validCSRFToken(sess, presented) {
+			t.Errorf("validCSRFToken(%q) = true, want false", presented)
+		}
+	}
+
+	if validCSRFToken(nil, "anything.at-all") {
+		t.Errorf("validCSRFToken with a nil session must not validate")
+	}
+}
@@ -7,31 +7,12 @@ import (
 	"strings"
 
 	"github.com/caiyeon/goldfish/vault"
-	"github.com/gorilla/csrf"
-	"github.com/gorilla/securecookie"
 	"github.com/labstack/echo"
 )
 
 // for returning JSON bodies
 type H map[string]interface{}
 
-// for storing ciphers of user credentials
-var scookie = &securecookie.SecureCookie{}
-
-func init() {
-	// setup cookie encryption keys
-	hashKey := securecookie.GenerateRandomKey(64)
-	blockKey := securecookie.GenerateRandomKey(32)
-	if hashKey == nil || blockKey == nil {
-		panic("Failed to generate random hashkey")
-	}
-	scookie = securecookie.New(hashKey, blockKey)
-	scookie = scookie.MaxAge(14400) // 8 hours
-	if scookie == nil {
-		panic("Failed to initialize gorilla/securecookie")
-	}
-}
-
 // returns the http status code found in the error message
 func parseError(c echo.Context, err error) error {
 	errCode := strings.Split(err.Error(), "Code:")
@@ -52,9 +33,27 @@ func parseError(c echo.Context, err error) error {
 	})
 }
 
+// FetchCSRF hands the caller a token bound to their own session: anyone
+// who steals it without also controlling the session cookie (e.g. via a
+// cookie-swap) cannot use it, since verifying the token requires the
+// session's CSRFSecret. See csrf.go
 func FetchCSRF() echo.HandlerFunc {
 	return func(c echo.Context) error {
-		c.Response().Writer.Header().Set("X-CSRF-Token", csrf.Token(c.Request()))
+		sess, err := fetchSession(c)
+		if err != nil {
+			return c.JSON(http.StatusForbidden, H{
+				"error": "Please login first",
+			})
+		}
+
+		token, err := newCSRFToken(sess)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, H{
+				"error": "Goldfish could not generate csrf token",
+			})
+		}
+
+		c.Response().Writer.Header().Set("X-CSRF-Token", token)
 		return c.JSON(http.StatusOK, H{
 			"status": "fetched",
 		})
@@ -103,19 +102,20 @@ func Login() echo.HandlerFunc {
 			})
 		}
 
-		// store auth.Type and auth.ID (now a cipher) in cookie
-		if encoded, err := scookie.Encode("auth", auth); err == nil {
-			cookie := &http.Cookie{
-				Name:  "auth",
-				Value: encoded,
-				Path:  "/",
-			}
-			http.SetCookie(c.Response().Writer, cookie)
-		} else {
+		// hand the encrypted auth to the active session store; only the
+		// ID it returns (an opaque blob for cookieSessionStore, a short
+		// random ID for the server-side stores) ever reaches the cookie
+		id, err := sessionStore.Create(auth, c.RealIP(), c.Request().UserAgent())
+		if err != nil {
 			return c.JSON(http.StatusInternalServerError, H{
-				"error": "Goldfish could not encode cookie",
+				"error": "Goldfish could not create session",
 			})
 		}
+		http.SetCookie(c.Response().Writer, &http.Cookie{
+			Name:  "auth",
+			Value: id,
+			Path:  "/",
+		})
 
 		// return useful information to user
 		return c.JSON(http.StatusOK, H{
@@ -147,6 +147,11 @@ func RenewSelf() echo.HandlerFunc {
 			return parseError(c, err)
 		}
 
+		// record that this session is still active, for stores that track it
+		if cookie, err := c.Request().Cookie("auth"); err == nil {
+			sessionStore.Touch(cookie.Value)
+		}
+
 		return c.JSON(http.StatusOK, H{
 			"data": map[string]interface{}{
 				"meta":     resp.Auth.Metadata,
@@ -169,20 +174,13 @@ func getSession(c echo.Context) (*vault.AuthInfo) {
 		return auth
 	}
 
-	// fetch auth from cookie
-	cookie, err := c.Request().Cookie("auth")
-	if err != nil {
-		c.JSON(http.StatusForbidden, H{
-			"error": "Please login first",
-		})
-		return nil
-	}
-	if err := scookie.Decode("auth", cookie.Value, &auth); err != nil {
-		c.JSON(http.StatusForbidden, H{
-			"error": "Please login first",
-		})
+	// resolves the cookie against the active session store and, on
+	// state-changing requests, requires the CSRF token bound to it
+	sess := requireCSRFSession(c)
+	if sess == nil {
 		return nil
 	}
+	auth = sess.Auth
 
 	// if cookie is valid, decrypt it with transit key
 	if err := auth.DecryptAuth(); err != nil {
@@ -191,3 +189,76 @@ func getSession(c echo.Context) (*vault.AuthInfo) {
 	}
 	return auth
 }
+
+// fetchSession resolves the cookie's session ID against the active
+// session store (cookieSessionStore treats the ID itself as the
+// encrypted blob; the others look it up server-side)
+func fetchSession(c echo.Context) (*Session, error) {
+	cookie, err := c.Request().Cookie("auth")
+	if err != nil {
+		return nil, err
+	}
+	return sessionStore.Fetch(cookie.Value)
+}
+
+// Logout invalidates the caller's session. For the server-side stores,
+// this revokes the session everywhere it is used (all tabs/devices); the
+// cookie-only store can only clear the browser's copy.
+//
+// Logout is state-changing, so it requires the same CSRF binding as any
+// other mutating handler, even though it doesn't need the decrypted
+// AuthInfo that getSession would otherwise provide
+func Logout() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if requireCSRFSession(c) == nil {
+			return nil
+		}
+
+		if cookie, err := c.Request().Cookie("auth"); err == nil {
+			sessionStore.Delete(cookie.Value)
+		}
+		http.SetCookie(c.Response().Writer, &http.Cookie{
+			Name:   "auth",
+			Value:  "",
+			Path:   "/",
+			MaxAge: -1,
+		})
+		return c.JSON(http.StatusOK, H{
+			"status": "Logged out",
+		})
+	}
+}
+
+// ListSessions is an admin-only endpoint, gated by requireAdmin, that
+// surfaces every session currently tracked by the active session store,
+// for revocation purposes
+func ListSessions() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		auth := requireAdmin(c)
+		if auth == nil {
+			return nil
+		}
+		defer auth.Clear()
+
+		sessions, err := sessionStore.List()
+		if err != nil {
+			return c.JSON(http.StatusNotImplemented, H{
+				"error": "Active session store does not support listing sessions",
+			})
+		}
+
+		result := make([]H, 0, len(sessions))
+		for _, sess := range sessions {
+			result = append(result, H{
+				"id":           sess.ID,
+				"issued_at":    sess.IssuedAt,
+				"last_renewed": sess.LastRenewed,
+				"ip":           sess.IP,
+				"user_agent":   sess.UserAgent,
+			})
+		}
+		return c.JSON(http.StatusOK, H{
+			"sessions": result,
+		})
+	}
+}
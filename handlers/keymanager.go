@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caiyeon/goldfish/config"
+	"github.com/caiyeon/goldfish/vault"
+	"github.com/gorilla/securecookie"
+	"github.com/labstack/echo"
+)
+
+// keyGeneration is one hash/block key pair, tagged with when it was minted
+type keyGeneration struct {
+	HashKey  []byte    `json:"hash_key"`
+	BlockKey []byte    `json:"block_key"`
+	Created  time.Time `json:"created"`
+}
+
+// keyManager owns the securecookie key material: it persists generations
+// in vault, rotates them on a schedule, and keeps scookie up to date so
+// that decoding a cookie always tries the current key before older ones
+type keyManager struct {
+	sync.RWMutex
+	vaultPath   string
+	interval    time.Duration
+	maxHistory  int
+	persist     bool            // false until InitKeyManager has configured vault
+	generations []keyGeneration // newest first
+}
+
+// km is the process-wide key manager, set up by InitKeyManager
+var km *keyManager
+
+// for storing ciphers of user credentials; index 0 is always the
+// current (newest) generation, the rest are kept so that sessions
+// started before a rotation can still be decoded
+var scookie []*securecookie.SecureCookie
+
+func init() {
+	// default to a single ephemeral key pair so the package still works
+	// before InitKeyManager has loaded the server config. Production
+	// deployments should call InitKeyManager, which persists and rotates
+	// keys via vault instead of silently logging everyone out on restart
+	km = &keyManager{
+		vaultPath:  "secret/goldfish/cookie-keys",
+		interval:   24 * time.Hour,
+		maxHistory: 2,
+	}
+	if err := km.rotate(); err != nil {
+		panic("Failed to initialize gorilla/securecookie: " + err.Error())
+	}
+}
+
+// InitKeyManager loads (or creates) persisted key generations from vault
+// at the configured path, and starts the background rotation schedule.
+// Call once during startup, after config.LoadConfig()
+func InitKeyManager(conf *config.Config) error {
+	km.Lock()
+	km.vaultPath = conf.CookieKeyVaultPath
+	km.interval = conf.CookieKeyRotationInterval
+	km.persist = true
+	km.Unlock()
+
+	if err := km.load(); err != nil {
+		// nothing persisted yet; mint the first generation
+		if err := km.rotate(); err != nil {
+			return err
+		}
+	}
+
+	go km.rotateOnSchedule()
+	return nil
+}
+
+// load fetches persisted generations from vault and rebuilds scookie.
+// Generations are stored as a single JSON-encoded blob (see rotate),
+// since vault.ReadFromVault decodes its JSON response into plain
+// map[string]interface{}/[]interface{}/string/float64 values and a naked
+// assertion to []keyGeneration would never succeed
+func (k *keyManager) load() error {
+	data, err := vault.ReadFromVault(k.vaultPath)
+	if err != nil {
+		return err
+	}
+
+	blob, ok := data["generations"].(string)
+	if !ok || blob == "" {
+		return errors.New("no cookie key generations persisted yet")
+	}
+
+	var gens []keyGeneration
+	if err := json.Unmarshal([]byte(blob), &gens); err != nil {
+		return err
+	}
+	if len(gens) == 0 {
+		return errors.New("no cookie key generations persisted yet")
+	}
+
+	k.Lock()
+	defer k.Unlock()
+	k.generations = gens
+	k.rebuildLocked()
+	return nil
+}
+
+// rotate mints a new key generation, persists the (trimmed) history to
+// vault, and rebuilds scookie so new cookies are signed with it while
+// cookies signed under the previous generation still decode
+func (k *keyManager) rotate() error {
+	hashKey := securecookie.GenerateRandomKey(64)
+	blockKey := securecookie.GenerateRandomKey(32)
+	if hashKey == nil || blockKey == nil {
+		return echoErrNotSupported
+	}
+
+	k.Lock()
+	defer k.Unlock()
+
+	k.generations = append([]keyGeneration{{
+		HashKey:  hashKey,
+		BlockKey: blockKey,
+		Created:  time.Now(),
+	}}, k.generations...)
+	if k.maxHistory > 0 && len(k.generations) > k.maxHistory {
+		k.generations = k.generations[:k.maxHistory]
+	}
+	k.rebuildLocked()
+
+	if k.persist {
+		blob, err := json.Marshal(k.generations)
+		if err != nil {
+			return err
+		}
+		return vault.WriteToVault(k.vaultPath, map[string]interface{}{
+			"generations": string(blob),
+		})
+	}
+	return nil
+}
+
+// rebuildLocked regenerates the scookie slice from k.generations.
+// Caller must hold the lock
+func (k *keyManager) rebuildLocked() {
+	cookies := make([]*securecookie.SecureCookie, 0, len(k.generations))
+	for _, gen := range k.generations {
+		sc := securecookie.New(gen.HashKey, gen.BlockKey).MaxAge(14400) // 4 hours
+		cookies = append(cookies, sc)
+	}
+	scookie = cookies
+}
+
+// rotateOnSchedule rotates keys at the configured interval until the
+// process exits
+func (k *keyManager) rotateOnSchedule() {
+	for range time.Tick(k.interval) {
+		k.rotate()
+	}
+}
+
+// encodeCookie signs a value with the current (newest) key generation.
+// km.RLock guards against encoding with a scookie slice that rotate is
+// concurrently replacing (rotate runs both on a schedule and from
+// ForceRotateKeys, so this can race with any in-flight request)
+func encodeCookie(name string, value interface{}) (string, error) {
+	km.RLock()
+	defer km.RUnlock()
+	if len(scookie) == 0 {
+		return "", echoErrNotSupported
+	}
+	return scookie[0].Encode(name, value)
+}
+
+// decodeCookie tries the current key generation, then falls back through
+// progressively older ones, so a rotation never invalidates a session
+// that was issued right before it. Held under km.RLock for the same
+// reason as encodeCookie
+func decodeCookie(name, value string, dst interface{}) error {
+	km.RLock()
+	defer km.RUnlock()
+	var err error
+	for _, sc := range scookie {
+		if err = sc.Decode(name, value, dst); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// ForceRotateKeys is an admin-only handler, gated by requireAdmin, that
+// rotates the securecookie keys immediately instead of waiting for the
+// scheduled interval. Routing it through requireAdmin also gives it the
+// same CSRF binding as any other mutating handler, since requireAdmin
+// calls getSession under the hood
+func ForceRotateKeys() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		auth := requireAdmin(c)
+		if auth == nil {
+			return nil
+		}
+		defer auth.Clear()
+
+		if err := km.rotate(); err != nil {
+			return c.JSON(http.StatusInternalServerError, H{
+				"error": "Goldfish could not rotate cookie keys",
+			})
+		}
+		return keyGenerationStatus(c)
+	}
+}
+
+// KeyGenerationStatus is an admin-only handler, gated by requireAdmin like
+// ForceRotateKeys, that surfaces the current key generation's age and the
+// configured rotation interval, without ever exposing the key material
+func KeyGenerationStatus() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		auth := requireAdmin(c)
+		if auth == nil {
+			return nil
+		}
+		defer auth.Clear()
+
+		return keyGenerationStatus(c)
+	}
+}
+
+func keyGenerationStatus(c echo.Context) error {
+	km.RLock()
+	defer km.RUnlock()
+	if len(km.generations) == 0 {
+		return c.JSON(http.StatusInternalServerError, H{
+			"error": "No cookie key generation available",
+		})
+	}
+	current := km.generations[0]
+	return c.JSON(http.StatusOK, H{
+		"data": map[string]interface{}{
+			"generation_created": current.Created,
+			"rotation_interval":  km.interval.String(),
+			"generations_kept":   len(km.generations),
+		},
+	})
+}
@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/caiyeon/goldfish/config"
+	"github.com/caiyeon/goldfish/vault"
+	"github.com/labstack/echo"
+	"golang.org/x/oauth2"
+)
+
+// oauthStateCookie is the name of the short-lived cookie that carries the
+// PKCE code verifier and anti-CSRF state between the start and callback legs
+var oauthStateCookie = "oauth_state"
+
+// oauthProvider bundles everything needed to drive an authorization-code
+// exchange for a single configured IdP (github, google, or generic OIDC)
+type oauthProvider struct {
+	Name       string
+	Config     *oauth2.Config
+	VaultRole  string // role configured on vault's jwt/oidc auth backend
+	VaultMount string // path the auth backend is mounted at, e.g. "oidc"
+}
+
+// providers is populated from config.Conf.OAuth on startup by LoadOAuthProviders
+var providers = map[string]*oauthProvider{}
+
+// LoadOAuthProviders reads the server config and builds an oauth2.Config
+// per provider. It should be called once, after config.LoadConfig()
+func LoadOAuthProviders(conf *config.Config) {
+	providers = map[string]*oauthProvider{}
+	for name, p := range conf.OAuth {
+		providers[name] = &oauthProvider{
+			Name:       name,
+			VaultRole:  p.VaultRole,
+			VaultMount: p.VaultMount,
+			Config: &oauth2.Config{
+				ClientID:     p.ClientID,
+				ClientSecret: p.ClientSecret,
+				RedirectURL:  p.RedirectURL,
+				Scopes:       p.Scopes,
+				Endpoint:     p.Endpoint(),
+			},
+		}
+	}
+}
+
+// StartOAuth redirects the user to the given provider's authorization
+// endpoint, stashing a PKCE verifier and state nonce in a short-lived cookie
+func StartOAuth() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		provider, ok := providers[c.Param("provider")]
+		if !ok {
+			return c.JSON(http.StatusNotFound, H{
+				"error": "Unknown oauth provider",
+			})
+		}
+
+		state, err := randomString(32)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, H{
+				"error": "Goldfish could not generate oauth state",
+			})
+		}
+		verifier, err := randomString(64)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, H{
+				"error": "Goldfish could not generate oauth state",
+			})
+		}
+
+		http.SetCookie(c.Response().Writer, &http.Cookie{
+			Name:     oauthStateCookie,
+			Value:    state + "." + verifier,
+			Path:     "/v1/auth/oauth/callback",
+			HttpOnly: true,
+			Secure:   true,
+		})
+
+		url := provider.Config.AuthCodeURL(state,
+			oauth2.SetAuthURLParam("code_challenge", pkceChallenge(verifier)),
+			oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+		)
+		return c.Redirect(http.StatusFound, url)
+	}
+}
+
+// OAuthCallback completes the authorization-code exchange, verifies the
+// returned identity with the IdP, and trades it for a vault token via
+// vault's JWT/OIDC auth backend before handing the user a goldfish session
+func OAuthCallback() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		provider, ok := providers[c.Param("provider")]
+		if !ok {
+			return c.JSON(http.StatusNotFound, H{
+				"error": "Unknown oauth provider",
+			})
+		}
+
+		cookie, err := c.Request().Cookie(oauthStateCookie)
+		if err != nil {
+			return c.JSON(http.StatusForbidden, H{
+				"error": "Missing oauth state, please try logging in again",
+			})
+		}
+		state, verifier, err := splitState(cookie.Value)
+		if err != nil || state != c.QueryParam("state") {
+			return c.JSON(http.StatusForbidden, H{
+				"error": "Invalid oauth state",
+			})
+		}
+
+		token, err := provider.Config.Exchange(c.Request().Context(), c.QueryParam("code"),
+			oauth2.SetAuthURLParam("code_verifier", verifier),
+		)
+		if err != nil {
+			return c.JSON(http.StatusUnauthorized, H{
+				"error": "Goldfish could not exchange oauth code",
+			})
+		}
+
+		idToken, ok := token.Extra("id_token").(string)
+		if !ok || idToken == "" {
+			return c.JSON(http.StatusUnauthorized, H{
+				"error": "OAuth provider did not return an id_token",
+			})
+		}
+
+		// exchange the verified identity for a vault token via the
+		// jwt/oidc auth backend, using the role configured for this provider
+		auth := &vault.AuthInfo{
+			Type:  "jwt",
+			ID:    idToken,
+			Role:  provider.VaultRole,
+			Mount: provider.VaultMount,
+		}
+		defer auth.Clear()
+
+		data, err := auth.Login()
+		if err != nil {
+			return parseError(c, err)
+		}
+
+		if err := auth.EncryptAuth(); err != nil {
+			return c.JSON(http.StatusInternalServerError, H{
+				"error": "Goldfish could not use transit key",
+			})
+		}
+
+		id, err := sessionStore.Create(auth, c.RealIP(), c.Request().UserAgent())
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, H{
+				"error": "Goldfish could not create session",
+			})
+		}
+		http.SetCookie(c.Response().Writer, &http.Cookie{
+			Name:  "auth",
+			Value: id,
+			Path:  "/",
+		})
+
+		// clear the one-time state cookie now that the exchange is done
+		http.SetCookie(c.Response().Writer, &http.Cookie{
+			Name:   oauthStateCookie,
+			Value:  "",
+			Path:   "/v1/auth/oauth/callback",
+			MaxAge: -1,
+		})
+
+		return c.JSON(http.StatusOK, H{
+			"status": "Logged in",
+			"data": map[string]interface{}{
+				"display_name": data["display_name"],
+				"id":           data["id"],
+				"meta":         data["meta"],
+				"policies":     data["policies"],
+				"renewable":    data["renewable"],
+				"ttl":          data["ttl"],
+			},
+		})
+	}
+}
+
+// randomString returns a URL-safe base64 string of n random bytes
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// splitState pulls the state nonce and PKCE verifier back out of the
+// cookie value set by StartOAuth
+func splitState(raw string) (state string, verifier string, err error) {
+	for i := 0; i < len(raw); i++ {
+		if raw[i] == '.' {
+			return raw[:i], raw[i+1:], nil
+		}
+	}
+	return "", "", echo.NewHTTPError(http.StatusForbidden, "malformed oauth state")
+}
+
+// pkceChallenge derives the S256 code_challenge from a code_verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,37 @@
+package handlers
+
+import "testing"
+
+func TestSplitState(t *testing.T) {
+	state, verifier, err := splitState("abc123.def456")
+	if err != nil {
+		t.Fatalf("splitState returned error: %v", err)
+	}
+	if state != "abc123" || verifier != "def456" {
+		t.Errorf("splitState = (%q, %q), want (%q, %q)", state, verifier, "abc123", "def456")
+	}
+}
+
+func TestSplitStateRejectsMissingSeparator(t *testing.T) {
+	if _, _, err := splitState("no-separator-here"); err == nil {
+		t.Errorf("expected an error for a value with no '.' separator")
+	}
+}
+
+func TestPKCEChallengeIsDeterministic(t *testing.T) {
+	verifier := "a-fixed-code-verifier"
+	first := pkceChallenge(verifier)
+	second := pkceChallenge(verifier)
+	if first != second {
+		t.Errorf("pkceChallenge is not deterministic: %q != %q", first, second)
+	}
+	if first == verifier {
+		t.Errorf("pkceChallenge must not return the verifier unchanged")
+	}
+}
+
+func TestPKCEChallengeDiffersPerVerifier(t *testing.T) {
+	if pkceChallenge("verifier-one") == pkceChallenge("verifier-two") {
+		t.Errorf("distinct verifiers must not produce the same challenge")
+	}
+}
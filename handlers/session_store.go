@@ -0,0 +1,337 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caiyeon/goldfish/vault"
+)
+
+// Session is the record a SessionStore keeps for a logged in user. For the
+// server-side stores only its ID leaves the server in the session cookie;
+// cookieSessionStore carries the encrypted Auth and CSRFSecret in the
+// cookie itself
+type Session struct {
+	ID          string
+	Auth        *vault.AuthInfo // encrypted via EncryptAuth, as it is today
+	CSRFSecret  string          // bound to this session; see FetchCSRF
+	IssuedAt    time.Time
+	LastRenewed time.Time
+	IP          string
+	UserAgent   string
+}
+
+// SessionStore abstracts where session state is kept, so Login/getSession/
+// RenewSelf don't need to know if a session lives in the cookie itself,
+// in memory, or in vault's KV backend
+type SessionStore interface {
+	// Create persists a brand new session and returns the ID to put in the cookie
+	Create(auth *vault.AuthInfo, ip, ua string) (id string, err error)
+
+	// Fetch looks up a session by the ID found in the cookie
+	Fetch(id string) (*Session, error)
+
+	// Touch updates LastRenewed, e.g. after a successful RenewSelf
+	Touch(id string) error
+
+	// Delete invalidates a session everywhere it is used (real logout)
+	Delete(id string) error
+
+	// List returns every session currently tracked (used by the admin
+	// sessions endpoint). The cookie-only store cannot support this
+	List() ([]*Session, error)
+}
+
+// sessionStore is the active SessionStore, set by InitSessionStore
+var sessionStore SessionStore = newCookieSessionStore()
+
+// InitSessionStore swaps the active SessionStore. Call during startup once
+// the server config (which picks the backing mode) has been loaded
+func InitSessionStore(store SessionStore) {
+	sessionStore = store
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// copyAuthInfo returns a shallow copy of auth. Callers like Login and
+// OAuthCallback defer auth.Clear() on the object they pass to
+// SessionStore.Create; a store that keeps that object in memory (rather
+// than serializing it, like the cookie and vault KV stores do) must hold
+// onto its own copy or the deferred Clear wipes the live session
+func copyAuthInfo(auth *vault.AuthInfo) *vault.AuthInfo {
+	if auth == nil {
+		return nil
+	}
+	clone := *auth
+	return &clone
+}
+
+// cookiePayload is what actually gets securecookie-encoded for
+// cookieSessionStore, since it has nowhere server-side to keep the CSRF
+// secret alongside the encrypted auth
+type cookiePayload struct {
+	Auth       *vault.AuthInfo
+	CSRFSecret string
+}
+
+// cookieSessionStore keeps no server-side state at all; it is the
+// pre-existing behaviour where the "session ID" handed back to the cookie
+// is actually the full securecookie-encrypted AuthInfo. It cannot support
+// logout-everywhere, revocation, or listing, since goldfish never sees
+// these sessions again once the cookie leaves the server
+type cookieSessionStore struct{}
+
+func newCookieSessionStore() *cookieSessionStore {
+	return &cookieSessionStore{}
+}
+
+func (s *cookieSessionStore) Create(auth *vault.AuthInfo, ip, ua string) (string, error) {
+	secret, err := newSessionID()
+	if err != nil {
+		return "", err
+	}
+	return encodeCookie("auth", &cookiePayload{Auth: auth, CSRFSecret: secret})
+}
+
+func (s *cookieSessionStore) Fetch(id string) (*Session, error) {
+	payload := &cookiePayload{}
+	if err := decodeCookie("auth", id, payload); err != nil {
+		return nil, err
+	}
+	return &Session{Auth: payload.Auth, CSRFSecret: payload.CSRFSecret}, nil
+}
+
+func (s *cookieSessionStore) Touch(id string) error {
+	return nil
+}
+
+func (s *cookieSessionStore) Delete(id string) error {
+	return echoErrNotSupported
+}
+
+func (s *cookieSessionStore) List() ([]*Session, error) {
+	return nil, echoErrNotSupported
+}
+
+// memorySessionStore keeps sessions in a map guarded by a mutex. Sessions
+// do not survive a process restart, but logout/revocation work across tabs
+type memorySessionStore struct {
+	sync.RWMutex
+	sessions map[string]*Session
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{
+		sessions: make(map[string]*Session),
+	}
+}
+
+func (s *memorySessionStore) Create(auth *vault.AuthInfo, ip, ua string) (string, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return "", err
+	}
+	secret, err := newSessionID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	s.Lock()
+	s.sessions[id] = &Session{
+		ID:          id,
+		Auth:        copyAuthInfo(auth),
+		CSRFSecret:  secret,
+		IssuedAt:    now,
+		LastRenewed: now,
+		IP:          ip,
+		UserAgent:   ua,
+	}
+	s.Unlock()
+	return id, nil
+}
+
+func (s *memorySessionStore) Fetch(id string) (*Session, error) {
+	s.RLock()
+	sess, ok := s.sessions[id]
+	s.RUnlock()
+	if !ok {
+		return nil, echoErrSessionNotFound
+	}
+
+	// hand back a copy, not the stored pointer: the caller (e.g.
+	// getSession) defers auth.Clear() on whatever it gets back, which
+	// must not reach into this store's own record
+	clone := *sess
+	clone.Auth = copyAuthInfo(sess.Auth)
+	return &clone, nil
+}
+
+func (s *memorySessionStore) Touch(id string) error {
+	s.Lock()
+	defer s.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return echoErrSessionNotFound
+	}
+	sess.LastRenewed = time.Now()
+	return nil
+}
+
+func (s *memorySessionStore) Delete(id string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+func (s *memorySessionStore) List() ([]*Session, error) {
+	s.RLock()
+	defer s.RUnlock()
+	result := make([]*Session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		clone := *sess
+		clone.Auth = copyAuthInfo(sess.Auth)
+		result = append(result, &clone)
+	}
+	return result, nil
+}
+
+// vaultKVSessionStore persists sessions under a configurable path in
+// vault's KV backend, keyed by the opaque session ID. This survives
+// process restarts and lets multiple goldfish instances share sessions
+type vaultKVSessionStore struct {
+	mountPath string // e.g. "secret/goldfish/sessions"
+}
+
+func newVaultKVSessionStore(mountPath string) *vaultKVSessionStore {
+	return &vaultKVSessionStore{mountPath: mountPath}
+}
+
+func (s *vaultKVSessionStore) Create(auth *vault.AuthInfo, ip, ua string) (string, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return "", err
+	}
+	secret, err := newSessionID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	sess := &Session{
+		ID:          id,
+		Auth:        auth,
+		CSRFSecret:  secret,
+		IssuedAt:    now,
+		LastRenewed: now,
+		IP:          ip,
+		UserAgent:   ua,
+	}
+	data, err := sessionToMap(sess)
+	if err != nil {
+		return "", err
+	}
+	if err := vault.WriteToVault(s.mountPath+"/"+id, data); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (s *vaultKVSessionStore) Fetch(id string) (*Session, error) {
+	data, err := vault.ReadFromVault(s.mountPath + "/" + id)
+	if err != nil {
+		return nil, err
+	}
+	return sessionFromMap(id, data)
+}
+
+func (s *vaultKVSessionStore) Touch(id string) error {
+	sess, err := s.Fetch(id)
+	if err != nil {
+		return err
+	}
+	sess.LastRenewed = time.Now()
+	data, err := sessionToMap(sess)
+	if err != nil {
+		return err
+	}
+	return vault.WriteToVault(s.mountPath+"/"+id, data)
+}
+
+func (s *vaultKVSessionStore) Delete(id string) error {
+	return vault.DeleteFromVault(s.mountPath + "/" + id)
+}
+
+func (s *vaultKVSessionStore) List() ([]*Session, error) {
+	ids, err := vault.ListFromVault(s.mountPath)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*Session, 0, len(ids))
+	for _, id := range ids {
+		sess, err := s.Fetch(id)
+		if err != nil {
+			continue
+		}
+		result = append(result, sess)
+	}
+	return result, nil
+}
+
+// sessionToMap and sessionFromMap are the only place a Session crosses the
+// vault KV API, which round-trips everything through JSON: a naked type
+// assertion like data["auth"].(*vault.AuthInfo) would never succeed,
+// since a decoded JSON response only ever yields map[string]interface{},
+// []interface{}, string, float64 and bool. Marshal/unmarshal the whole
+// struct instead so nested types survive the round trip intact
+func sessionToMap(sess *Session) (map[string]interface{}, error) {
+	blob, err := json.Marshal(sess)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"session": string(blob),
+	}, nil
+}
+
+func sessionFromMap(id string, data map[string]interface{}) (*Session, error) {
+	blob, ok := data["session"].(string)
+	if !ok {
+		return nil, errors.New("malformed session record")
+	}
+
+	sess := &Session{}
+	if err := json.Unmarshal([]byte(blob), sess); err != nil {
+		return nil, err
+	}
+	sess.ID = id
+	return sess, nil
+}
+
+var (
+	echoErrNotSupported    = httpError(http.StatusNotImplemented, "session store does not support this operation")
+	echoErrSessionNotFound = httpError(http.StatusForbidden, "session not found")
+)
+
+func httpError(code int, msg string) error {
+	return &storeError{code: code, msg: msg}
+}
+
+type storeError struct {
+	code int
+	msg  string
+}
+
+func (e *storeError) Error() string {
+	return e.msg
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/caiyeon/goldfish/vault"
+)
+
+// roundTripThroughJSON mimics what vault.ReadFromVault actually hands
+// back: a map[string]interface{} decoded from a JSON response body, where
+// every value is a string/float64/bool/map/slice, never a concrete Go type
+func roundTripThroughJSON(t *testing.T, data map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	blob, err := json.Marshal(data)
+	if err != nil {
+		t.Fatalf("failed to marshal fixture: %v", err)
+	}
+	var out map[string]interface{}
+	if err := json.Unmarshal(blob, &out); err != nil {
+		t.Fatalf("failed to unmarshal fixture: %v", err)
+	}
+	return out
+}
+
+// TestSessionToFromMap exercises the path vaultKVSessionStore actually
+// takes: a map[string]interface{} produced by sessionToMap, fed back
+// through sessionFromMap as if it had round-tripped through vault's JSON
+// KV API. A naked type assertion on the nested fields would fail here.
+func TestSessionToFromMap(t *testing.T) {
+	original := &Session{
+		ID:          "should-be-overwritten",
+		Auth:        &vault.AuthInfo{Type: "token", ID: "s.abc123"},
+		CSRFSecret:  "supersecret",
+		IssuedAt:    time.Now().Truncate(time.Second),
+		LastRenewed: time.Now().Truncate(time.Second),
+		IP:          "127.0.0.1",
+		UserAgent:   "go-test",
+	}
+
+	data, err := sessionToMap(original)
+	if err != nil {
+		t.Fatalf("sessionToMap returned error: %v", err)
+	}
+
+	// simulate the round trip through vault's JSON KV API, where every
+	// value decodes back out as a plain string/float64/map, never the
+	// original concrete type
+	roundTripped := roundTripThroughJSON(t, data)
+
+	got, err := sessionFromMap("new-id", roundTripped)
+	if err != nil {
+		t.Fatalf("sessionFromMap returned error: %v", err)
+	}
+
+	if got.ID != "new-id" {
+		t.Errorf("expected ID to be set from the lookup key, got %q", got.ID)
+	}
+	if got.Auth == nil || got.Auth.Type != original.Auth.Type || got.Auth.ID != original.Auth.ID {
+		t.Errorf("Auth did not survive the round trip: got %+v", got.Auth)
+	}
+	if got.CSRFSecret != original.CSRFSecret {
+		t.Errorf("CSRFSecret = %q, want %q", got.CSRFSecret, original.CSRFSecret)
+	}
+	if !got.IssuedAt.Equal(original.IssuedAt) {
+		t.Errorf("IssuedAt = %v, want %v", got.IssuedAt, original.IssuedAt)
+	}
+	if !got.LastRenewed.Equal(original.LastRenewed) {
+		t.Errorf("LastRenewed = %v, want %v", got.LastRenewed, original.LastRenewed)
+	}
+	if got.IP != original.IP || got.UserAgent != original.UserAgent {
+		t.Errorf("IP/UserAgent did not survive the round trip: got %+v", got)
+	}
+}
+
+// TestMemorySessionStoreDoesNotAliasAuth guards against the exact
+// sequence every call site hits in production: Login/OAuthCallback pass
+// auth to sessionStore.Create, then `defer auth.Clear()` fires when the
+// handler returns. If Create or Fetch ever hand back the caller's own
+// *vault.AuthInfo pointer instead of a copy, that deferred Clear wipes
+// the session this same request just created.
+func TestMemorySessionStoreDoesNotAliasAuth(t *testing.T) {
+	store := newMemorySessionStore()
+	auth := &vault.AuthInfo{Type: "token", ID: "s.abc123"}
+
+	id, err := store.Create(auth, "127.0.0.1", "go-test")
+	if err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+
+	// mirrors the `defer auth.Clear()` every handler performs on its own
+	// copy right after handing auth to Create
+	auth.Clear()
+
+	sess, err := store.Fetch(id)
+	if err != nil {
+		t.Fatalf("Fetch returned error: %v", err)
+	}
+	if sess.Auth == nil || sess.Auth.Type != "token" || sess.Auth.ID != "s.abc123" {
+		t.Fatalf("stored session was corrupted by clearing the caller's auth: got %+v", sess.Auth)
+	}
+
+	// clearing the copy Fetch just handed back must not reach into the
+	// store's own record either
+	sess.Auth.Clear()
+
+	sessAgain, err := store.Fetch(id)
+	if err != nil {
+		t.Fatalf("second Fetch returned error: %v", err)
+	}
+	if sessAgain.Auth == nil || sessAgain.Auth.Type != "token" || sessAgain.Auth.ID != "s.abc123" {
+		t.Fatalf("stored session was corrupted by clearing a Fetch result: got %+v", sessAgain.Auth)
+	}
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/caiyeon/goldfish/config"
+	"github.com/caiyeon/goldfish/vault"
+	"github.com/labstack/echo"
+)
+
+// totpMountPrefix is the path under which goldfish looks for TOTP secrets
+// engine mounts, set once at startup by InitTOTP
+var totpMountPrefix = "totp"
+
+// InitTOTP configures where ListTOTP/GenerateTOTPCode look for TOTP
+// mounts. Call during startup, after config.LoadConfig()
+func InitTOTP(conf *config.Config) {
+	if conf.TOTPMountPrefix != "" {
+		totpMountPrefix = conf.TOTPMountPrefix
+	}
+}
+
+// ListTOTP discovers TOTP secrets engine mounts under totpMountPrefix and
+// returns the key names found under each, so the frontend can render a
+// list of accounts without ever touching a seed
+func ListTOTP() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		auth := getSession(c)
+		if auth == nil {
+			return nil
+		}
+		defer auth.Clear()
+
+		mounts, err := vault.ListTOTPMounts(auth, totpMountPrefix)
+		if err != nil {
+			return parseError(c, err)
+		}
+
+		result := make(map[string][]string, len(mounts))
+		for _, mount := range mounts {
+			keys, err := vault.ListTOTPKeys(auth, mount)
+			if err != nil {
+				return parseError(c, err)
+			}
+			result[mount] = keys
+		}
+
+		return c.JSON(http.StatusOK, H{
+			"data": map[string]interface{}{
+				"mounts": result,
+			},
+		})
+	}
+}
+
+// GenerateTOTPCode issues a totp/code/<name> read against the given mount
+// and returns the current code, never the underlying seed
+func GenerateTOTPCode() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		auth := getSession(c)
+		if auth == nil {
+			return nil
+		}
+		defer auth.Clear()
+
+		mount := c.Param("mount")
+		name := c.Param("name")
+		if mount == "" || name == "" {
+			return c.JSON(http.StatusBadRequest, H{
+				"error": "Missing totp mount or key name",
+			})
+		}
+
+		code, err := vault.GenerateTOTPCode(auth, mount, name)
+		if err != nil {
+			return parseError(c, err)
+		}
+
+		return c.JSON(http.StatusOK, H{
+			"data": map[string]interface{}{
+				"code":       code.Code,
+				"expires_at": code.ExpiresAt,
+				"period":     code.Period,
+			},
+		})
+	}
+}
+
+// StreamTOTPCode polls vault for a fresh code shortly after each period
+// rolls over, and streams it down as server-sent events so the frontend
+// can render a countdown ring without hammering Vault on every tick
+func StreamTOTPCode() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		auth := getSession(c)
+		if auth == nil {
+			return nil
+		}
+		defer auth.Clear()
+
+		mount := c.Param("mount")
+		name := c.Param("name")
+		if mount == "" || name == "" {
+			return c.JSON(http.StatusBadRequest, H{
+				"error": "Missing totp mount or key name",
+			})
+		}
+
+		res := c.Response()
+		res.Header().Set(echo.HeaderContentType, "text/event-stream")
+		res.Header().Set("Cache-Control", "no-cache")
+		res.WriteHeader(http.StatusOK)
+
+		for {
+			code, err := vault.GenerateTOTPCode(auth, mount, name)
+			if err != nil {
+				// the 200 status line already went out above, so a
+				// fresh JSON error response would arrive as malformed
+				// garbage mid-stream; send it as its own SSE event instead
+				writeSSEError(res, err)
+				return nil
+			}
+
+			payload, err := json.Marshal(map[string]interface{}{
+				"code":       code.Code,
+				"expires_at": code.ExpiresAt,
+				"period":     code.Period,
+			})
+			if err != nil {
+				writeSSEError(res, err)
+				return nil
+			}
+			fmt.Fprintf(res, "data: %s\n\n", payload)
+			res.Flush()
+
+			wait := time.Until(code.ExpiresAt)
+			if wait <= 0 {
+				wait = time.Duration(code.Period) * time.Second
+			}
+
+			select {
+			case <-c.Request().Context().Done():
+				return nil
+			case <-time.After(wait):
+			}
+		}
+	}
+}
+
+// writeSSEError reports a failure mid-stream as its own "error" event,
+// since the response has already been committed to a 200 text/event-stream
+// by the time a StreamTOTPCode iteration can fail
+func writeSSEError(res *echo.Response, err error) {
+	payload, marshalErr := json.Marshal(H{"error": err.Error()})
+	if marshalErr != nil {
+		payload = []byte(`{"error":"internal error"}`)
+	}
+	fmt.Fprintf(res, "event: error\ndata: %s\n\n", payload)
+	res.Flush()
+}